@@ -0,0 +1,74 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * ipp-usb.conf loading
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// confPath is the default location of ipp-usb.conf
+const confPath = "/etc/ipp-usb.conf"
+
+// Conf holds everything PnPStart and main() need from ipp-usb.conf
+type Conf struct {
+	Listeners       []PnPEventListener
+	Filter          *UsbFilter
+	QuarantineGrace time.Duration
+}
+
+// loadIniFile loads path as an ini.File, allowing the same section name
+// (e.g. "filter") to repeat, since ipp-usb.conf uses repeated stanzas
+// for ordered, multi-entry configuration
+func loadIniFile(path string) (*ini.File, error) {
+	cfg, err := ini.LoadSources(ini.LoadOptions{AllowNonUniqueSections: true}, path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return cfg, nil
+}
+
+// LoadConf loads and parses ipp-usb.conf at path
+func LoadConf(path string) (*Conf, error) {
+	cfg, err := loadIniFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &Conf{QuarantineGrace: quarantineGracePeriod}
+
+	options := cfg.Section("options")
+
+	if script := options.Key("event-script").String(); script != "" {
+		conf.Listeners = append(conf.Listeners, NewExecListener(script))
+	}
+
+	if url := options.Key("event-webhook").String(); url != "" {
+		conf.Listeners = append(conf.Listeners, NewWebhookListener(url))
+	}
+
+	if q := options.Key("quarantine").String(); q != "" {
+		grace, err := time.ParseDuration(q)
+		if err != nil {
+			return nil, fmt.Errorf("options.quarantine: %s", err)
+		}
+		conf.QuarantineGrace = grace
+	}
+
+	filter, err := NewUsbFilter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	conf.Filter = filter
+
+	return conf, nil
+}
@@ -0,0 +1,61 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * ipp-usb.conf loading
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConf(t *testing.T, body string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ipp-usb.conf")
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	return path
+}
+
+func TestLoadConfQuarantineDefault(t *testing.T) {
+	path := writeConf(t, "[options]\n")
+
+	conf, err := LoadConf(path)
+	if err != nil {
+		t.Fatalf("LoadConf: %s", err)
+	}
+
+	if conf.QuarantineGrace != quarantineGracePeriod {
+		t.Errorf("QuarantineGrace = %s, want the default %s", conf.QuarantineGrace, quarantineGracePeriod)
+	}
+}
+
+func TestLoadConfQuarantineOverride(t *testing.T) {
+	path := writeConf(t, "[options]\nquarantine = 30s\n")
+
+	conf, err := LoadConf(path)
+	if err != nil {
+		t.Fatalf("LoadConf: %s", err)
+	}
+
+	if conf.QuarantineGrace != 30*time.Second {
+		t.Errorf("QuarantineGrace = %s, want 30s", conf.QuarantineGrace)
+	}
+}
+
+func TestLoadConfQuarantineInvalid(t *testing.T) {
+	path := writeConf(t, "[options]\nquarantine = not-a-duration\n")
+
+	if _, err := LoadConf(path); err == nil {
+		t.Fatalf("LoadConf: expected an error for an invalid quarantine duration, got nil")
+	}
+}
@@ -0,0 +1,137 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Quarantine of detached devices, to survive a quick replug
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// quarantineGracePeriod is how long a detached device is kept alive,
+// waiting for a possible reappearance, before it is closed for good.
+// Configurable via the "quarantine" directive in ipp-usb.conf
+var quarantineGracePeriod = 15 * time.Second
+
+// DeviceIdentity identifies a device across a replug. Unlike UsbAddr
+// (bus/address), it survives a reconnect: vendor, product and serial
+// number don't change when the kernel renumbers the device after a
+// thermal/power hiccup, while bus/address usually do
+type DeviceIdentity struct {
+	Vendor       uint16
+	Product      uint16
+	SerialNumber string
+}
+
+// NewDeviceIdentity derives a DeviceIdentity from a device descriptor
+func NewDeviceIdentity(desc UsbDeviceDesc) DeviceIdentity {
+	return DeviceIdentity{
+		Vendor:       desc.Vendor,
+		Product:      desc.Product,
+		SerialNumber: desc.SerialNumber,
+	}
+}
+
+// Quarantinable is the subset of Device's behavior the quarantineMap
+// depends on. Keeping it this narrow (rather than taking a *Device
+// directly) means the map's Add/Reclaim/expire timing logic can be unit
+// tested with a fake, independently of Device's real implementation
+type Quarantinable interface {
+	// Quarantine marks the device as quarantined: its HTTP layer must
+	// start answering requests with 503 Service Unavailable and a
+	// Retry-After header instead of touching a USB transport that may
+	// vanish under it (see TransportHandoff, which Device's HTTP
+	// handler consults to implement this)
+	Quarantine()
+
+	// Close releases the device for good
+	Close()
+}
+
+// quarantineEntry is one device waiting in the quarantineMap for a
+// possible reappearance
+type quarantineEntry struct {
+	dev   Quarantinable
+	timer *time.Timer
+}
+
+// quarantineMap holds devices that were detached but not yet closed,
+// keyed by DeviceIdentity, so PnPStart can tell a momentary replug from
+// a genuine removal
+type quarantineMap struct {
+	lock    sync.Mutex
+	entries map[DeviceIdentity]*quarantineEntry
+}
+
+// newQuarantineMap creates an empty quarantineMap
+func newQuarantineMap() *quarantineMap {
+	return &quarantineMap{entries: make(map[DeviceIdentity]*quarantineEntry)}
+}
+
+// Add quarantines dev under identity for quarantineGracePeriod. Unless
+// Reclaim is called first, dev is closed for good once the timer fires
+func (qm *quarantineMap) Add(identity DeviceIdentity, dev Quarantinable) {
+	dev.Quarantine()
+
+	qm.lock.Lock()
+	defer qm.lock.Unlock()
+
+	qm.entries[identity] = &quarantineEntry{
+		dev:   dev,
+		timer: time.AfterFunc(quarantineGracePeriod, func() { qm.expire(identity) }),
+	}
+}
+
+// expire closes the quarantined device identified by identity, unless
+// it has already been reclaimed
+func (qm *quarantineMap) expire(identity DeviceIdentity) {
+	qm.lock.Lock()
+	entry, ok := qm.entries[identity]
+	if ok {
+		delete(qm.entries, identity)
+	}
+	qm.lock.Unlock()
+
+	if ok {
+		Log.Debug('Q', "quarantine %s: grace period expired, closing", identity.SerialNumber)
+		entry.dev.Close()
+	}
+}
+
+// Reclaim looks up a quarantined device matching identity. If found, it
+// cancels the expiry timer, drops the entry and returns the device, so
+// PnPStart can rebind it to the freshly (re)attached libusb handle
+// instead of creating a new one. It returns nil if nothing matches
+func (qm *quarantineMap) Reclaim(identity DeviceIdentity) Quarantinable {
+	qm.lock.Lock()
+	defer qm.lock.Unlock()
+
+	entry, ok := qm.entries[identity]
+	if !ok {
+		return nil
+	}
+
+	entry.timer.Stop()
+	delete(qm.entries, identity)
+
+	return entry.dev
+}
+
+// CloseAll closes every still-quarantined device and cancels their
+// timers; called from PnPStart's termination path
+func (qm *quarantineMap) CloseAll() {
+	qm.lock.Lock()
+	entries := qm.entries
+	qm.entries = make(map[DeviceIdentity]*quarantineEntry)
+	qm.lock.Unlock()
+
+	for _, entry := range entries {
+		entry.timer.Stop()
+		entry.dev.Close()
+	}
+}
@@ -0,0 +1,104 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Quarantine of detached devices, to survive a quick replug
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeQuarantinable is a Quarantinable double, so quarantineMap's
+// timing can be tested without a real Device
+type fakeQuarantinable struct {
+	quarantined bool
+	closed      chan struct{}
+}
+
+func newFakeQuarantinable() *fakeQuarantinable {
+	return &fakeQuarantinable{closed: make(chan struct{})}
+}
+
+func (f *fakeQuarantinable) Quarantine() { f.quarantined = true }
+func (f *fakeQuarantinable) Close()      { close(f.closed) }
+
+func withQuarantineGracePeriod(d time.Duration, fn func()) {
+	saved := quarantineGracePeriod
+	quarantineGracePeriod = d
+	defer func() { quarantineGracePeriod = saved }()
+	fn()
+}
+
+func TestQuarantineMapReclaimBeforeExpiry(t *testing.T) {
+	withQuarantineGracePeriod(time.Hour, func() {
+		qm := newQuarantineMap()
+		identity := DeviceIdentity{Vendor: 0x04b8, Product: 0x0005, SerialNumber: "S1"}
+		dev := newFakeQuarantinable()
+
+		qm.Add(identity, dev)
+		if !dev.quarantined {
+			t.Fatalf("Add() did not quarantine the device")
+		}
+
+		reclaimed := qm.Reclaim(identity)
+		if reclaimed != dev {
+			t.Fatalf("Reclaim() did not return the quarantined device")
+		}
+
+		select {
+		case <-dev.closed:
+			t.Fatalf("Reclaim() must not close the device")
+		default:
+		}
+
+		if qm.Reclaim(identity) != nil {
+			t.Fatalf("Reclaim() must remove the entry after returning it once")
+		}
+	})
+}
+
+func TestQuarantineMapExpiresAfterGracePeriod(t *testing.T) {
+	withQuarantineGracePeriod(20*time.Millisecond, func() {
+		qm := newQuarantineMap()
+		identity := DeviceIdentity{Vendor: 0x04b8, Product: 0x0005, SerialNumber: "S1"}
+		dev := newFakeQuarantinable()
+
+		qm.Add(identity, dev)
+
+		select {
+		case <-dev.closed:
+		case <-time.After(time.Second):
+			t.Fatalf("device was not closed after the grace period elapsed")
+		}
+
+		if qm.Reclaim(identity) != nil {
+			t.Fatalf("an expired entry must not be reclaimable")
+		}
+	})
+}
+
+func TestQuarantineMapCloseAll(t *testing.T) {
+	withQuarantineGracePeriod(time.Hour, func() {
+		qm := newQuarantineMap()
+		devA := newFakeQuarantinable()
+		devB := newFakeQuarantinable()
+
+		qm.Add(DeviceIdentity{SerialNumber: "A"}, devA)
+		qm.Add(DeviceIdentity{SerialNumber: "B"}, devB)
+
+		qm.CloseAll()
+
+		for name, dev := range map[string]*fakeQuarantinable{"A": devA, "B": devB} {
+			select {
+			case <-dev.closed:
+			default:
+				t.Errorf("CloseAll() did not close device %s", name)
+			}
+		}
+	})
+}
@@ -0,0 +1,35 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * LAN discovery of proxied IPP-over-USB devices
+ */
+
+package main
+
+// DiscoveryAnnouncer announces (and withdraws) the HTTP proxy endpoint of
+// a locally attached IPP-over-USB device, so printer-discovery clients on
+// the LAN can find it without needing CUPS or Avahi running on the host.
+//
+// PnPStart calls Announce when a device is added to devByAddr and Withdraw
+// when it is removed. Implementations must be safe for concurrent use, as
+// they typically keep advertisements alive from a background goroutine
+// while PnPStart continues to process PnP events.
+//
+// SSDP is the only backend shipped today; the interface exists so mDNS
+// and WS-Discovery backends can be plugged in later without touching
+// PnPStart.
+type DiscoveryAnnouncer interface {
+	// Announce starts advertising dev on the LAN. It is called once the
+	// device's HTTP proxy endpoint is up and ready to accept connections.
+	Announce(dev *Device) error
+
+	// Withdraw stops advertising the device at addr and, if the
+	// underlying protocol supports it, sends a final "goodbye" notice.
+	Withdraw(addr UsbAddr)
+
+	// Close shuts the announcer down, withdrawing everything it still
+	// advertises.
+	Close()
+}
@@ -0,0 +1,45 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Entry point
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	checkFilter := false
+	for _, arg := range os.Args[1:] {
+		if arg == "--check-filter" {
+			checkFilter = true
+		}
+	}
+
+	conf, err := LoadConf(confPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if checkFilter {
+		if err := CheckFilter(conf.Filter); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	PnPSetFilter(conf.Filter)
+	for _, l := range conf.Listeners {
+		PnPAddListener(l)
+	}
+	quarantineGracePeriod = conf.QuarantineGrace
+
+	PnPStart(false)
+}
@@ -32,8 +32,20 @@ const (
 func PnPStart(exitWhenIdle bool) PnPExitReason {
 	devices := UsbAddrList{}
 	devByAddr := make(map[string]*Device)
+	identityByAddr := make(map[string]DeviceIdentity)
+	quarantine := newQuarantineMap()
 	sigChan := make(chan os.Signal, 1)
 
+	var announcer DiscoveryAnnouncer
+	ssdp, err := NewSsdpAnnouncer()
+	if err != nil {
+		Log.Debug(' ', "SSDP: %s, device discovery disabled", err)
+	} else {
+		announcer = ssdp
+	}
+
+	events := newPnPEventQueue()
+
 	signal.Notify(sigChan,
 		os.Signal(syscall.SIGINT),
 		os.Signal(syscall.SIGTERM),
@@ -54,10 +66,38 @@ loop:
 			devices = newdevices
 
 			for _, addr := range added {
+				if pnpFilter != nil && !pnpFilter.Allowed(dev_descs[addr]) {
+					Log.Debug('F', "filter %s: device skipped", addr)
+					continue
+				}
+
+				identity := NewDeviceIdentity(dev_descs[addr])
+				if reclaimed := quarantine.Reclaim(identity); reclaimed != nil {
+					dev := reclaimed.(*Device)
+					Log.Debug('+', "PNP %s: device reconnected within grace period, rebinding", addr)
+					dev.Rebind(dev_descs[addr])
+					devByAddr[addr.MapKey()] = dev
+					identityByAddr[addr.MapKey()] = identity
+					if announcer != nil {
+						if err := announcer.Announce(dev); err != nil {
+							Log.Debug(' ', "SSDP %s: %s", addr, err)
+						}
+					}
+					events.dispatchAttached(dev)
+					continue
+				}
+
 				Log.Debug('+', "PNP %s: added", addr)
 				dev, err := NewDevice(dev_descs[addr])
 				if err == nil {
 					devByAddr[addr.MapKey()] = dev
+					identityByAddr[addr.MapKey()] = identity
+					if announcer != nil {
+						if err := announcer.Announce(dev); err != nil {
+							Log.Debug(' ', "SSDP %s: %s", addr, err)
+						}
+					}
+					events.dispatchAttached(dev)
 				} else {
 					Log.Error('!', "PNP %s: %s", addr, err)
 				}
@@ -67,8 +107,14 @@ loop:
 				Log.Debug('-', "PNP %s: removed", addr)
 				dev, ok := devByAddr[addr.MapKey()]
 				if ok {
-					dev.Close()
+					identity := identityByAddr[addr.MapKey()]
+					if announcer != nil {
+						announcer.Withdraw(addr)
+					}
+					events.dispatchDetached(addr)
+					quarantine.Add(identity, dev)
 					delete(devByAddr, addr.MapKey())
+					delete(identityByAddr, addr.MapKey())
 				}
 			}
 		}
@@ -102,5 +148,12 @@ loop:
 	}
 
 	done.Wait()
+	events.drain(ctx)
+	quarantine.CloseAll()
+
+	if announcer != nil {
+		announcer.Close()
+	}
+
 	return PnPTerm
 }
@@ -0,0 +1,194 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Pluggable hotplug event listeners
+ */
+
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// PnPEventListener is notified by PnPStart whenever a device is attached
+// to, or detached from, the system. Listeners are registered with
+// PnPAddListener before PnPStart is called.
+//
+// Calls into a listener are serialized per device (attach and detach of
+// the same UsbAddr never run concurrently), but calls for different
+// devices may run in parallel. Implementations must not block for long,
+// as that delays delivery of subsequent events to the same listener;
+// anything that can take a while (running a script, an HTTP POST) must
+// be dispatched through pnpEventQueue, which PnPStart's dispatchAttached/
+// dispatchDetached calls never block on, regardless of how slow a
+// listener is.
+type PnPEventListener interface {
+	// OnDeviceAttached is called right after dev has been added to
+	// devByAddr and is ready to serve requests
+	OnDeviceAttached(dev *Device)
+
+	// OnDeviceDetached is called right after addr has been removed
+	// from devByAddr
+	OnDeviceDetached(addr UsbAddr)
+}
+
+// pnpListeners is the set of listeners registered via PnPAddListener
+var pnpListeners struct {
+	lock sync.Mutex
+	list []PnPEventListener
+}
+
+// PnPAddListener registers a PnPEventListener. It must be called before
+// PnPStart, typically from main(), based on configuration
+func PnPAddListener(l PnPEventListener) {
+	pnpListeners.lock.Lock()
+	defer pnpListeners.lock.Unlock()
+
+	pnpListeners.list = append(pnpListeners.list, l)
+}
+
+// pnpListenersSnapshot returns a copy of the currently registered
+// listeners, safe to range over without holding the lock
+func pnpListenersSnapshot() []PnPEventListener {
+	pnpListeners.lock.Lock()
+	defer pnpListeners.lock.Unlock()
+
+	list := make([]PnPEventListener, len(pnpListeners.list))
+	copy(list, pnpListeners.list)
+	return list
+}
+
+// pnpEventJob is a single (listener, device) notification to dispatch
+type pnpEventJob struct {
+	devKey   string
+	attached bool // true: OnDeviceAttached, false: OnDeviceDetached
+	dev      *Device
+	addr     UsbAddr
+	listener PnPEventListener
+}
+
+// deviceGate serializes pnpEventQueue jobs for one device: jobs for the
+// same device take turns holding mu, in dispatch order. refs tracks how
+// many jobs currently reference this gate, so pnpEventQueue can evict it
+// once none do, instead of keeping one entry per device forever
+type deviceGate struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// pnpEventQueue dispatches PnPEventListener calls without ever blocking
+// the caller: each call is a freshly spawned goroutine, so an arbitrary
+// burst of attach/detach events (a hub losing power) can never back up
+// behind a slow listener and stall PnPStart's loop. Calls for the same
+// device are still serialized, via a per-device deviceGate
+type pnpEventQueue struct {
+	wg sync.WaitGroup
+
+	lock  sync.Mutex
+	gates map[string]*deviceGate
+}
+
+// newPnPEventQueue creates an empty pnpEventQueue
+func newPnPEventQueue() *pnpEventQueue {
+	return &pnpEventQueue{gates: make(map[string]*deviceGate)}
+}
+
+// acquireGate returns the deviceGate for devKey, creating it on first
+// use, and registers one more reference to it
+func (q *pnpEventQueue) acquireGate(devKey string) *deviceGate {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	g, ok := q.gates[devKey]
+	if !ok {
+		g = &deviceGate{}
+		q.gates[devKey] = g
+	}
+	g.refs++
+
+	return g
+}
+
+// releaseGate drops a reference to devKey's deviceGate, evicting it once
+// nothing references it anymore, so pnpEventQueue.gates doesn't grow
+// without bound over the daemon's lifetime as devices come and go
+func (q *pnpEventQueue) releaseGate(devKey string, g *deviceGate) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	g.refs--
+	if g.refs == 0 {
+		delete(q.gates, devKey)
+	}
+}
+
+// runJob serializes job against other jobs for the same device, then
+// delivers it to its listener
+func (q *pnpEventQueue) runJob(job pnpEventJob) {
+	defer q.wg.Done()
+
+	gate := q.acquireGate(job.devKey)
+	gate.mu.Lock()
+	defer func() {
+		gate.mu.Unlock()
+		q.releaseGate(job.devKey, gate)
+	}()
+
+	if job.attached {
+		job.listener.OnDeviceAttached(job.dev)
+	} else {
+		job.listener.OnDeviceDetached(job.addr)
+	}
+}
+
+// dispatch spawns a goroutine running job, without blocking the caller
+func (q *pnpEventQueue) dispatch(job pnpEventJob) {
+	q.wg.Add(1)
+	go q.runJob(job)
+}
+
+// dispatchAttached notifies every registered listener that dev was
+// attached. It never blocks, however slow a listener turns out to be
+func (q *pnpEventQueue) dispatchAttached(dev *Device) {
+	for _, l := range pnpListenersSnapshot() {
+		q.dispatch(pnpEventJob{
+			devKey:   dev.UsbAddr.MapKey(),
+			attached: true,
+			dev:      dev,
+			listener: l,
+		})
+	}
+}
+
+// dispatchDetached notifies every registered listener that addr was
+// detached. It never blocks, however slow a listener turns out to be
+func (q *pnpEventQueue) dispatchDetached(addr UsbAddr) {
+	for _, l := range pnpListenersSnapshot() {
+		q.dispatch(pnpEventJob{
+			devKey:   addr.MapKey(),
+			attached: false,
+			addr:     addr,
+			listener: l,
+		})
+	}
+}
+
+// drain waits for already-dispatched jobs to finish, up to ctx's
+// deadline; jobs still running past the deadline are abandoned (their
+// goroutines keep running to completion in the background)
+func (q *pnpEventQueue) drain(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		Log.Debug(' ', "event listeners: drain timed out, some events may be lost")
+	}
+}
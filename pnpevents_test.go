@@ -0,0 +1,147 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Pluggable hotplug event listeners
+ */
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEventListener is a PnPEventListener double that blocks in
+// OnDeviceAttached/OnDeviceDetached until release is closed, and
+// records the order in which calls started and finished
+type fakeEventListener struct {
+	release chan struct{}
+
+	lock   sync.Mutex
+	events []string
+}
+
+func (l *fakeEventListener) OnDeviceAttached(dev *Device) { l.run("attach") }
+func (l *fakeEventListener) OnDeviceDetached(addr UsbAddr) { l.run("detach") }
+
+func (l *fakeEventListener) run(what string) {
+	l.record(what + ":start")
+	if l.release != nil {
+		<-l.release
+	}
+	l.record(what + ":end")
+}
+
+func (l *fakeEventListener) record(s string) {
+	l.lock.Lock()
+	l.events = append(l.events, s)
+	l.lock.Unlock()
+}
+
+func (l *fakeEventListener) snapshot() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+func TestPnPEventQueueDispatchDoesNotBlock(t *testing.T) {
+	listener := &fakeEventListener{release: make(chan struct{})}
+	q := newPnPEventQueue()
+
+	done := make(chan struct{})
+	go func() {
+		// A burst of events for the same device: with a blocked
+		// listener, none of these dispatches may block the caller
+		for i := 0; i < 200; i++ {
+			q.dispatch(pnpEventJob{devKey: "same-device", attached: true, listener: listener})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("dispatch() blocked the caller while a listener was stuck")
+	}
+
+	close(listener.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	q.drain(ctx)
+}
+
+func TestPnPEventQueueSerializesPerDevice(t *testing.T) {
+	listener := &fakeEventListener{release: make(chan struct{})}
+	q := newPnPEventQueue()
+
+	q.dispatch(pnpEventJob{devKey: "dev-1", attached: true, listener: listener})
+	q.dispatch(pnpEventJob{devKey: "dev-1", attached: false, listener: listener})
+
+	// give the first job time to start (and, if buggy, the second too)
+	time.Sleep(50 * time.Millisecond)
+	if got := listener.snapshot(); len(got) != 1 || got[0] != "attach:start" {
+		t.Fatalf("second job for the same device must wait for the first: got %v", got)
+	}
+
+	close(listener.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	q.drain(ctx)
+
+	got := listener.snapshot()
+	want := []string{"attach:start", "attach:end", "detach:start", "detach:end"}
+	if len(got) != len(want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("events = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPnPEventQueueEvictsGateAfterCompletion(t *testing.T) {
+	listener := &fakeEventListener{}
+	q := newPnPEventQueue()
+
+	for i := 0; i < 10; i++ {
+		q.dispatch(pnpEventJob{devKey: "dev-1", attached: true, listener: listener})
+		q.dispatch(pnpEventJob{devKey: "dev-1", attached: false, listener: listener})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	q.drain(ctx)
+
+	q.lock.Lock()
+	n := len(q.gates)
+	q.lock.Unlock()
+
+	if n != 0 {
+		t.Fatalf("gates map leaked %d entries after all jobs completed", n)
+	}
+}
+
+func TestPnPEventQueueDrainTimeout(t *testing.T) {
+	listener := &fakeEventListener{release: make(chan struct{})}
+	q := newPnPEventQueue()
+
+	q.dispatch(pnpEventJob{devKey: "dev-1", attached: true, listener: listener})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	q.drain(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("drain() did not honor ctx's deadline, took %s", elapsed)
+	}
+
+	close(listener.release) // let the still-running goroutine finish
+}
@@ -0,0 +1,94 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Exec-based hotplug event listener
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// execTimeout bounds how long an event script may run. PnPEventListener
+// calls must not block for long (see its doc comment), and are
+// serialized per device by pnpEventQueue, so a hung script would
+// otherwise stall delivery of every later event for that device forever.
+// It's a var, not a const, so tests can shrink it
+var execTimeout = 10 * time.Second
+
+// ExecListener is a PnPEventListener that runs a user-provided script on
+// every attach/detach event, passing device details via environment
+// variables:
+//
+//	IPPUSB_EVENT       "attach" or "detach"
+//	IPPUSB_VENDOR      USB vendor ID, 4 hex digits
+//	IPPUSB_PRODUCT     USB product ID, 4 hex digits
+//	IPPUSB_SERIAL      USB serial number, if known
+//	IPPUSB_HTTP_PORT   TCP port the device's HTTP proxy listens on
+//	IPPUSB_UUID        the device's IPP UUID, if known
+//
+// It is configured by the "event-script" directive in ipp-usb.conf.
+type ExecListener struct {
+	path string
+}
+
+// NewExecListener creates an ExecListener that runs the script at path
+func NewExecListener(path string) *ExecListener {
+	return &ExecListener{path: path}
+}
+
+// OnDeviceAttached implements PnPEventListener
+func (el *ExecListener) OnDeviceAttached(dev *Device) {
+	el.run("attach", dev.UsbAddr, dev.VendorID(), dev.ProductID(),
+		dev.SerialNumber(), dev.HTTPPort(), dev.UUID())
+}
+
+// OnDeviceDetached implements PnPEventListener
+func (el *ExecListener) OnDeviceDetached(addr UsbAddr) {
+	el.run("detach", addr, 0, 0, "", 0, "")
+}
+
+// execEnv builds the environment an event script runs with: the
+// process's own environment (so the script can still find PATH, HOME,
+// etc.), plus the IPPUSB_* variables describing the event
+func execEnv(event string, vendor, product uint16, serial string, httpPort int, uuid string) []string {
+	return append(os.Environ(),
+		"IPPUSB_EVENT="+event,
+		fmt.Sprintf("IPPUSB_VENDOR=%04x", vendor),
+		fmt.Sprintf("IPPUSB_PRODUCT=%04x", product),
+		"IPPUSB_SERIAL="+serial,
+		fmt.Sprintf("IPPUSB_HTTP_PORT=%d", httpPort),
+		"IPPUSB_UUID="+uuid,
+	)
+}
+
+// run executes the configured script with the event encoded into its
+// environment, logging (but not propagating) any failure
+func (el *ExecListener) run(event string, addr UsbAddr, vendor, product uint16,
+	serial string, httpPort int, uuid string) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, el.path)
+	cmd.Env = execEnv(event, vendor, product, serial, httpPort, uuid)
+	// Don't wait for children of a killed script to close its output
+	cmd.WaitDelay = time.Second
+
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		Log.Error('!', "event-script %s: %s: timed out after %s", addr, el.path, execTimeout)
+	} else if err != nil {
+		Log.Error('!', "event-script %s: %s: %s", addr, el.path, err)
+	}
+	if len(out) != 0 {
+		Log.Debug(' ', "event-script %s: %s", addr, out)
+	}
+}
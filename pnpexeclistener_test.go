@@ -0,0 +1,97 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Exec-based hotplug event listener
+ */
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScript(t *testing.T, body string) string {
+	t.Helper()
+
+	f, err := os.CreateTemp("", "ipp-usb-event-*.sh")
+	if err != nil {
+		t.Fatalf("CreateTemp: %s", err)
+	}
+	if _, err := f.WriteString(body); err != nil {
+		t.Fatalf("WriteString: %s", err)
+	}
+	f.Close()
+	if err := os.Chmod(f.Name(), 0o755); err != nil {
+		t.Fatalf("Chmod: %s", err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	return f.Name()
+}
+
+func TestExecEnvPreservesProcessEnvironment(t *testing.T) {
+	env := execEnv("attach", 0x04b8, 0x0005, "SERIAL1", 1234, "uuid-1")
+
+	want := []string{
+		"IPPUSB_EVENT=attach",
+		"IPPUSB_VENDOR=04b8",
+		"IPPUSB_PRODUCT=0005",
+		"IPPUSB_SERIAL=SERIAL1",
+		"IPPUSB_HTTP_PORT=1234",
+		"IPPUSB_UUID=uuid-1",
+	}
+
+	for _, w := range want {
+		found := false
+		for _, e := range env {
+			if e == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("execEnv() missing %q", w)
+		}
+	}
+
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, "PATH=") {
+			found := false
+			for _, got := range env {
+				if got == e {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Errorf("execEnv() must preserve the process's PATH, but dropped it")
+			}
+		}
+	}
+}
+
+func TestExecListenerTimesOut(t *testing.T) {
+	saved := execTimeout
+	execTimeout = 50 * time.Millisecond
+	defer func() { execTimeout = saved }()
+
+	script := writeScript(t, "#!/bin/sh\nsleep 5\n")
+	el := NewExecListener(script)
+
+	done := make(chan struct{})
+	go func() {
+		el.run("attach", UsbAddr{}, 0x04b8, 0x0005, "SERIAL1", 1234, "uuid-1")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("run() did not honor execTimeout and kill the hung script")
+	}
+}
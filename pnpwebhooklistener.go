@@ -0,0 +1,108 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Webhook-based hotplug event listener
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhookRetries is the number of additional attempts after the first
+// one fails, before a webhook delivery is given up on
+const webhookRetries = 3
+
+// webhookRetryDelay is the base delay between retries; it doubles after
+// every failed attempt (plain exponential backoff). It's a var, not a
+// const, so tests can shrink it
+var webhookRetryDelay = time.Second
+
+// webhookEvent is the JSON body POSTed to the configured URL
+type webhookEvent struct {
+	Event    string `json:"event"` // "attach" or "detach"
+	Vendor   string `json:"vendor"`
+	Product  string `json:"product"`
+	Serial   string `json:"serial,omitempty"`
+	HTTPPort int    `json:"http_port,omitempty"`
+	UUID     string `json:"uuid,omitempty"`
+}
+
+// WebhookListener is a PnPEventListener that POSTs a JSON description of
+// every attach/detach event to a configured URL, retrying with backoff
+// on failure. It is configured by the "event-webhook" directive in
+// ipp-usb.conf.
+type WebhookListener struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookListener creates a WebhookListener that posts to url
+func NewWebhookListener(url string) *WebhookListener {
+	return &WebhookListener{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// OnDeviceAttached implements PnPEventListener
+func (wl *WebhookListener) OnDeviceAttached(dev *Device) {
+	wl.post(webhookEvent{
+		Event:    "attach",
+		Vendor:   fmt.Sprintf("%04x", dev.VendorID()),
+		Product:  fmt.Sprintf("%04x", dev.ProductID()),
+		Serial:   dev.SerialNumber(),
+		HTTPPort: dev.HTTPPort(),
+		UUID:     dev.UUID(),
+	}, dev.UsbAddr)
+}
+
+// OnDeviceDetached implements PnPEventListener
+func (wl *WebhookListener) OnDeviceDetached(addr UsbAddr) {
+	wl.post(webhookEvent{Event: "detach"}, addr)
+}
+
+// post sends evt to the configured URL, retrying with exponential
+// backoff on failure; it logs (but does not propagate) a final failure
+func (wl *WebhookListener) post(evt webhookEvent, addr UsbAddr) {
+	body, err := json.Marshal(evt)
+	if err != nil {
+		Log.Error('!', "event-webhook %s: %s", addr, err)
+		return
+	}
+
+	delay := webhookRetryDelay
+	for attempt := 0; attempt <= webhookRetries; attempt++ {
+		if attempt != 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		resp, err := wl.client.Post(wl.url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 400 {
+				return
+			}
+			err = errorString(resp.Status)
+		}
+
+		Log.Debug(' ', "event-webhook %s: attempt %d: %s", addr, attempt+1, err)
+	}
+
+	Log.Error('!', "event-webhook %s: giving up after %d attempts", addr, webhookRetries+1)
+}
+
+// errorString is a plain string that implements the error interface,
+// used to wrap an HTTP status line as an error without importing
+// "errors" just for that
+type errorString string
+
+func (e errorString) Error() string { return string(e) }
@@ -0,0 +1,82 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Webhook-based hotplug event listener
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func withWebhookRetryDelay(d time.Duration, fn func()) {
+	saved := webhookRetryDelay
+	webhookRetryDelay = d
+	defer func() { webhookRetryDelay = saved }()
+	fn()
+}
+
+func TestWebhookListenerPostsEventBody(t *testing.T) {
+	var got webhookEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	wl := NewWebhookListener(srv.URL)
+	wl.post(webhookEvent{Event: "detach"}, UsbAddr{})
+
+	if got.Event != "detach" {
+		t.Fatalf("server received event %q, want %q", got.Event, "detach")
+	}
+}
+
+func TestWebhookListenerRetriesOnFailure(t *testing.T) {
+	withWebhookRetryDelay(time.Millisecond, func() {
+		var attempts int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&attempts, 1)
+			if n < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer srv.Close()
+
+		wl := NewWebhookListener(srv.URL)
+		wl.post(webhookEvent{Event: "attach"}, UsbAddr{})
+
+		if got := atomic.LoadInt32(&attempts); got != 3 {
+			t.Fatalf("server saw %d attempts, want 3 (2 failures then a success)", got)
+		}
+	})
+}
+
+func TestWebhookListenerGivesUpAfterMaxRetries(t *testing.T) {
+	withWebhookRetryDelay(time.Millisecond, func() {
+		var attempts int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer srv.Close()
+
+		wl := NewWebhookListener(srv.URL)
+		wl.post(webhookEvent{Event: "attach"}, UsbAddr{})
+
+		if got := atomic.LoadInt32(&attempts); got != webhookRetries+1 {
+			t.Fatalf("server saw %d attempts, want %d (1 initial + %d retries)",
+				got, webhookRetries+1, webhookRetries)
+		}
+	})
+}
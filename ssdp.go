@@ -0,0 +1,325 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * SSDP/UPnP-IGD announcement of proxied IPP-over-USB devices
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ssdpMulticastAddr is the well-known SSDP multicast group and port
+const ssdpMulticastAddr = "239.255.255.250:1900"
+
+// ssdpMaxAge is the value advertised in CACHE-CONTROL: max-age. Refreshes
+// are sent at half of this interval, as recommended by the UPnP spec.
+const ssdpMaxAge = 1800 * time.Second
+
+// ssdpDevice holds everything SsdpAnnouncer needs to answer M-SEARCH
+// requests and send NOTIFY ssdp:alive/ssdp:byebye for a single device
+type ssdpDevice struct {
+	addr     UsbAddr
+	uuid     string
+	urf      string
+	pdl      string
+	location string // URL of the device's HTTP proxy endpoint
+	done     chan struct{}
+}
+
+// SsdpAnnouncer is a DiscoveryAnnouncer that advertises proxied devices
+// over SSDP (UPnP device discovery), so plain UPnP printer-discovery
+// clients on the LAN can find them without CUPS/Avahi.
+//
+// It binds a UDP4 socket per non-loopback, non-point-to-point interface,
+// listens for M-SEARCH requests and answers them (after a random delay
+// bounded by the request's MX header), and periodically re-sends
+// NOTIFY ssdp:alive at half of ssdpMaxAge.
+type SsdpAnnouncer struct {
+	lock    sync.Mutex
+	devices map[string]*ssdpDevice // keyed by UsbAddr.MapKey()
+	conns   []*net.UDPConn
+	wg      sync.WaitGroup
+	closed  chan struct{}
+}
+
+// NewSsdpAnnouncer creates a new SsdpAnnouncer and starts listening for
+// M-SEARCH requests on all suitable network interfaces
+func NewSsdpAnnouncer() (*SsdpAnnouncer, error) {
+	sa := &SsdpAnnouncer{
+		devices: make(map[string]*ssdpDevice),
+		closed:  make(chan struct{}),
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("SSDP: %s", err)
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 ||
+			iface.Flags&net.FlagLoopback != 0 ||
+			iface.Flags&net.FlagPointToPoint != 0 {
+			continue
+		}
+
+		conn, err := sa.listen(iface)
+		if err != nil {
+			Log.Debug(' ', "SSDP %s: %s", iface.Name, err)
+			continue
+		}
+
+		sa.conns = append(sa.conns, conn)
+		sa.wg.Add(1)
+		go sa.serve(conn)
+	}
+
+	if len(sa.conns) == 0 {
+		return nil, fmt.Errorf("SSDP: no suitable network interface found")
+	}
+
+	return sa, nil
+}
+
+// listen joins the SSDP multicast group on the given interface and
+// returns the resulting socket
+func (sa *SsdpAnnouncer) listen(iface net.Interface) (*net.UDPConn, error) {
+	group, err := net.ResolveUDPAddr("udp4", ssdpMulticastAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", &iface, group)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// serve reads and answers M-SEARCH requests arriving on conn, until the
+// announcer is closed
+func (sa *SsdpAnnouncer) serve(conn *net.UDPConn) {
+	defer sa.wg.Done()
+
+	buf := make([]byte, 2048)
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := conn.ReadFromUDP(buf)
+
+		select {
+		case <-sa.closed:
+			return
+		default:
+		}
+
+		if err != nil {
+			continue
+		}
+
+		st, mx, ok := parseSsdpSearch(buf[:n])
+		if !ok {
+			continue
+		}
+
+		// Respond after a random delay in [0, mx], per the UPnP spec,
+		// so many devices on a busy network don't answer all at once
+		delay := time.Duration(rand.Intn(mx+1)) * time.Second
+		sa.lock.Lock()
+		devs := make([]*ssdpDevice, 0, len(sa.devices))
+		for _, dev := range sa.devices {
+			if ssdpMatchesSearchTarget(st, dev.uuid) {
+				devs = append(devs, dev)
+			}
+		}
+		sa.lock.Unlock()
+
+		for _, dev := range devs {
+			go sa.reply(conn, from, dev, delay)
+		}
+	}
+}
+
+// ssdpSearchTarget is the ST header value we advertise ourselves as
+const ssdpSearchTarget = "urn:schemas-upnp-org:device:Printer:1"
+
+// ssdpMatchesSearchTarget reports whether st, the ST header of an
+// incoming M-SEARCH, is one we should answer: a search for everything
+// ("ssdp:all"), for any root device ("upnp:rootdevice"), or specifically
+// for our Printer device type or its UUID
+func ssdpMatchesSearchTarget(st, uuid string) bool {
+	switch st {
+	case "ssdp:all", "upnp:rootdevice", ssdpSearchTarget, "uuid:" + uuid:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseSsdpSearch checks if data is a valid M-SEARCH request and, if so,
+// returns its ST and MX values. It returns ok == false if data isn't a
+// well-formed M-SEARCH request (missing/wrong MAN, missing MX, or missing
+// ST)
+func parseSsdpSearch(data []byte) (st string, mx int, ok bool) {
+	lines := strings.Split(string(data), "\r\n")
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "M-SEARCH ") {
+		return "", -1, false
+	}
+
+	mx = -1
+	man := false
+	for _, line := range lines[1:] {
+		switch {
+		case strings.HasPrefix(strings.ToUpper(line), "MAN:"):
+			man = strings.Contains(line, `"ssdp:discover"`)
+		case strings.HasPrefix(strings.ToUpper(line), "MX:"):
+			fmt.Sscanf(strings.TrimSpace(line[3:]), "%d", &mx)
+		case strings.HasPrefix(strings.ToUpper(line), "ST:"):
+			st = strings.TrimSpace(line[3:])
+		}
+	}
+
+	if !man || mx < 0 || st == "" {
+		return "", -1, false
+	}
+	if mx > 5 {
+		mx = 5 // cap, as recommended by the UPnP spec
+	}
+
+	return st, mx, true
+}
+
+// reply sends a unicast M-SEARCH response for dev to addr, after delay
+func (sa *SsdpAnnouncer) reply(conn *net.UDPConn, addr *net.UDPAddr, dev *ssdpDevice, delay time.Duration) {
+	time.Sleep(delay)
+
+	packet := "HTTP/1.1 200 OK\r\n" +
+		fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", int(ssdpMaxAge.Seconds())) +
+		fmt.Sprintf("LOCATION: %s\r\n", dev.location) +
+		"SERVER: ipp-usb UPnP/1.0\r\n" +
+		"ST: urn:schemas-upnp-org:device:Printer:1\r\n" +
+		fmt.Sprintf("USN: uuid:%s::urn:schemas-upnp-org:device:Printer:1\r\n", dev.uuid) +
+		"\r\n"
+
+	conn.WriteToUDP([]byte(packet), addr)
+}
+
+// notify sends an SSDP NOTIFY packet (ssdp:alive or ssdp:byebye) for dev
+// to the multicast group, on every interface this announcer listens on
+func (sa *SsdpAnnouncer) notify(dev *ssdpDevice, alive bool) {
+	nts := "ssdp:byebye"
+	extra := ""
+	if alive {
+		nts = "ssdp:alive"
+		extra = fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\nLOCATION: %s\r\n",
+			int(ssdpMaxAge.Seconds()), dev.location)
+	}
+
+	packet := "NOTIFY * HTTP/1.1\r\n" +
+		"HOST: " + ssdpMulticastAddr + "\r\n" +
+		extra +
+		"NT: urn:schemas-upnp-org:device:Printer:1\r\n" +
+		fmt.Sprintf("NTS: %s\r\n", nts) +
+		"SERVER: ipp-usb UPnP/1.0\r\n" +
+		fmt.Sprintf("USN: uuid:%s::urn:schemas-upnp-org:device:Printer:1\r\n", dev.uuid) +
+		"\r\n"
+
+	group, err := net.ResolveUDPAddr("udp4", ssdpMulticastAddr)
+	if err != nil {
+		return
+	}
+
+	for _, conn := range sa.conns {
+		conn.WriteToUDP([]byte(packet), group)
+	}
+}
+
+// refresh periodically re-sends NOTIFY ssdp:alive for dev, at half of
+// ssdpMaxAge, until dev.done is closed
+func (sa *SsdpAnnouncer) refresh(dev *ssdpDevice) {
+	ticker := time.NewTicker(ssdpMaxAge / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sa.notify(dev, true)
+		case <-dev.done:
+			return
+		}
+	}
+}
+
+// Announce starts advertising dev on the LAN over SSDP
+func (sa *SsdpAnnouncer) Announce(dev *Device) error {
+	ssdpDev := &ssdpDevice{
+		addr:     dev.UsbAddr,
+		uuid:     dev.UUID(),
+		urf:      dev.UrfAttr(),
+		pdl:      dev.PdlAttr(),
+		location: fmt.Sprintf("http://%s/", dev.HTTPAddr()),
+		done:     make(chan struct{}),
+	}
+
+	sa.lock.Lock()
+	sa.devices[dev.UsbAddr.MapKey()] = ssdpDev
+	sa.lock.Unlock()
+
+	sa.notify(ssdpDev, true)
+
+	sa.wg.Add(1)
+	go func() {
+		defer sa.wg.Done()
+		sa.refresh(ssdpDev)
+	}()
+
+	return nil
+}
+
+// Withdraw stops advertising the device at addr and sends ssdp:byebye
+func (sa *SsdpAnnouncer) Withdraw(addr UsbAddr) {
+	sa.lock.Lock()
+	ssdpDev, ok := sa.devices[addr.MapKey()]
+	if ok {
+		delete(sa.devices, addr.MapKey())
+	}
+	sa.lock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	close(ssdpDev.done)
+	sa.notify(ssdpDev, false)
+}
+
+// Close shuts the announcer down, withdrawing everything it still
+// advertises
+func (sa *SsdpAnnouncer) Close() {
+	sa.lock.Lock()
+	devs := make([]*ssdpDevice, 0, len(sa.devices))
+	for _, dev := range sa.devices {
+		devs = append(devs, dev)
+	}
+	sa.devices = make(map[string]*ssdpDevice)
+	sa.lock.Unlock()
+
+	for _, dev := range devs {
+		close(dev.done)
+		sa.notify(dev, false)
+	}
+
+	close(sa.closed)
+	for _, conn := range sa.conns {
+		conn.Close()
+	}
+	sa.wg.Wait()
+}
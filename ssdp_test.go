@@ -0,0 +1,95 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * SSDP/UPnP-IGD announcement of proxied IPP-over-USB devices
+ */
+
+package main
+
+import "testing"
+
+func TestParseSsdpSearch(t *testing.T) {
+	type testCase struct {
+		request string
+		wantST  string
+		wantMX  int
+		wantOK  bool
+	}
+
+	tests := []testCase{
+		{
+			request: "M-SEARCH * HTTP/1.1\r\n" +
+				"HOST: 239.255.255.250:1900\r\n" +
+				"MAN: \"ssdp:discover\"\r\n" +
+				"MX: 3\r\n" +
+				"ST: ssdp:all\r\n\r\n",
+			wantST: "ssdp:all", wantMX: 3, wantOK: true,
+		},
+		{
+			// MX above the spec's cap must be clamped, not rejected
+			request: "M-SEARCH * HTTP/1.1\r\n" +
+				"MAN: \"ssdp:discover\"\r\n" +
+				"MX: 120\r\n" +
+				"ST: upnp:rootdevice\r\n\r\n",
+			wantST: "upnp:rootdevice", wantMX: 5, wantOK: true,
+		},
+		{
+			// Missing MAN: ssdp:discover is not a discovery request
+			request: "M-SEARCH * HTTP/1.1\r\n" +
+				"MX: 3\r\n" +
+				"ST: ssdp:all\r\n\r\n",
+			wantOK: false,
+		},
+		{
+			// Missing ST must not be treated as a match
+			request: "M-SEARCH * HTTP/1.1\r\n" +
+				"MAN: \"ssdp:discover\"\r\n" +
+				"MX: 3\r\n\r\n",
+			wantOK: false,
+		},
+		{
+			request: "NOTIFY * HTTP/1.1\r\n\r\n",
+			wantOK:  false,
+		},
+	}
+
+	for _, test := range tests {
+		st, mx, ok := parseSsdpSearch([]byte(test.request))
+		if ok != test.wantOK {
+			t.Errorf("parseSsdpSearch(%q): ok = %v, want %v", test.request, ok, test.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if st != test.wantST || mx != test.wantMX {
+			t.Errorf("parseSsdpSearch(%q) = (%q, %d), want (%q, %d)",
+				test.request, st, mx, test.wantST, test.wantMX)
+		}
+	}
+}
+
+func TestSsdpMatchesSearchTarget(t *testing.T) {
+	const uuid = "4509a320-00a0-008f-00b6-002507510dc8"
+
+	tests := []struct {
+		st   string
+		want bool
+	}{
+		{"ssdp:all", true},
+		{"upnp:rootdevice", true},
+		{ssdpSearchTarget, true},
+		{"uuid:" + uuid, true},
+		{"urn:schemas-upnp-org:service:ContentDirectory:1", false},
+		{"uuid:some-other-device", false},
+	}
+
+	for _, test := range tests {
+		got := ssdpMatchesSearchTarget(test.st, uuid)
+		if got != test.want {
+			t.Errorf("ssdpMatchesSearchTarget(%q, uuid) = %v, want %v", test.st, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Atomic handle swap for quarantined devices, and the HTTP-layer side
+ * effect (503 Service Unavailable) while a device is quarantined
+ */
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// UsbTransportHandle is the live libusb handle a Device's USB transport
+// talks through. Device.Rebind swaps it out via TransportHandoff when
+// the device reappears after a replug, so in-flight IPP requests survive
+// the hiccup instead of failing
+type UsbTransportHandle interface {
+	// Close releases the handle: closes interfaces, frees resources
+	Close()
+}
+
+// TransportHandoff lets a Device keep serving HTTP while its underlying
+// USB transport is quarantined, or is being rebound to a fresh libusb
+// handle after a replug.
+//
+// Device embeds one TransportHandoff per device. Quarantine/Unquarantine
+// and Rebind (called from PnPStart via the Quarantinable interface and
+// Device.Rebind respectively) forward to it; Device's HTTP handler wraps
+// its mux with QuarantineMiddleware so a request that arrives while the
+// transport is quarantined gets 503 instead of failing against a handle
+// that is mid-replug.
+type TransportHandoff struct {
+	lock        sync.RWMutex
+	handle      UsbTransportHandle
+	quarantined int32 // atomic bool, 0 or 1
+
+	inflight sync.WaitGroup
+}
+
+// NewTransportHandoff wraps handle, the transport's initial libusb
+// handle, in a TransportHandoff
+func NewTransportHandoff(handle UsbTransportHandle) *TransportHandoff {
+	return &TransportHandoff{handle: handle}
+}
+
+// Quarantine marks the transport as quarantined
+func (h *TransportHandoff) Quarantine() {
+	atomic.StoreInt32(&h.quarantined, 1)
+}
+
+// Unquarantine clears the quarantined flag
+func (h *TransportHandoff) Unquarantine() {
+	atomic.StoreInt32(&h.quarantined, 0)
+}
+
+// IsQuarantined reports whether the transport is currently quarantined
+func (h *TransportHandoff) IsQuarantined() bool {
+	return atomic.LoadInt32(&h.quarantined) != 0
+}
+
+// Enter must be called by the transport before starting a bulk transfer
+// on the current handle, and Leave once it completes. Tracking these
+// lets Rebind drain outstanding transfers before swapping the handle.
+// Enter returns ok == false (and the caller must not proceed) if the
+// transport is currently quarantined.
+func (h *TransportHandoff) Enter() (handle UsbTransportHandle, ok bool) {
+	h.lock.RLock()
+	if h.IsQuarantined() {
+		h.lock.RUnlock()
+		return nil, false
+	}
+
+	h.inflight.Add(1)
+	handle = h.handle
+	h.lock.RUnlock()
+
+	return handle, true
+}
+
+// Leave releases a handle obtained from Enter
+func (h *TransportHandoff) Leave() {
+	h.inflight.Done()
+}
+
+// Rebind atomically swaps in a freshly (re)opened libusb handle: it
+// drains outstanding bulk transfers (waits for every outstanding
+// Enter/Leave pair to finish), installs the new handle, closes the old
+// one and clears the quarantined flag, so in-flight and new requests
+// resume against the new handle transparently
+func (h *TransportHandoff) Rebind(handle UsbTransportHandle) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.inflight.Wait()
+
+	old := h.handle
+	h.handle = handle
+	atomic.StoreInt32(&h.quarantined, 0)
+
+	if old != nil {
+		old.Close()
+	}
+}
+
+// quarantineRetryAfterSeconds is the Retry-After value returned to
+// clients that hit a quarantined device. It is deliberately close to
+// the lower end of quarantineGracePeriod: most replugs that matter
+// (a thermal/power hiccup) resolve in well under a second
+const quarantineRetryAfterSeconds = 5
+
+// QuarantineMiddleware wraps next so that, while h is quarantined,
+// requests get 503 Service Unavailable and a Retry-After header instead
+// of being forwarded to a transport that may be mid-replug
+func QuarantineMiddleware(h *TransportHandoff, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.IsQuarantined() {
+			w.Header().Set("Retry-After", strconv.Itoa(quarantineRetryAfterSeconds))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,105 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Atomic handle swap for quarantined devices
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeHandle struct{ closed bool }
+
+func (h *fakeHandle) Close() { h.closed = true }
+
+func TestTransportHandoffQuarantine(t *testing.T) {
+	h := NewTransportHandoff(&fakeHandle{})
+
+	if h.IsQuarantined() {
+		t.Fatalf("fresh TransportHandoff must not start quarantined")
+	}
+
+	h.Quarantine()
+	if !h.IsQuarantined() {
+		t.Fatalf("Quarantine() did not mark the transport quarantined")
+	}
+
+	if _, ok := h.Enter(); ok {
+		t.Fatalf("Enter() must fail while quarantined")
+	}
+
+	h.Unquarantine()
+	if h.IsQuarantined() {
+		t.Fatalf("Unquarantine() did not clear the flag")
+	}
+}
+
+func TestTransportHandoffRebindDrainsInflight(t *testing.T) {
+	oldHandle := &fakeHandle{}
+	h := NewTransportHandoff(oldHandle)
+
+	_, ok := h.Enter()
+	if !ok {
+		t.Fatalf("Enter() should succeed on a non-quarantined transport")
+	}
+
+	rebound := make(chan struct{})
+	go func() {
+		h.Rebind(&fakeHandle{})
+		close(rebound)
+	}()
+
+	select {
+	case <-rebound:
+		t.Fatalf("Rebind() must wait for the in-flight transfer to Leave() first")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	h.Leave()
+
+	select {
+	case <-rebound:
+	case <-time.After(time.Second):
+		t.Fatalf("Rebind() did not complete after the in-flight transfer left")
+	}
+
+	if !oldHandle.closed {
+		t.Errorf("Rebind() did not close the old handle")
+	}
+	if h.IsQuarantined() {
+		t.Errorf("Rebind() must clear the quarantined flag")
+	}
+}
+
+func TestQuarantineMiddleware(t *testing.T) {
+	h := NewTransportHandoff(&fakeHandle{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mw := QuarantineMiddleware(h, next)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	w := httptest.NewRecorder()
+	mw.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("non-quarantined request: got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	h.Quarantine()
+	w = httptest.NewRecorder()
+	mw.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("quarantined request: got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("quarantined request: missing Retry-After header")
+	}
+}
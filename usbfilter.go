@@ -0,0 +1,198 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB device allow/deny filtering
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+
+	"gopkg.in/ini.v1"
+)
+
+// UsbFilterAction is the action a UsbFilterRule takes when it matches
+// a device
+type UsbFilterAction int
+
+const (
+	UsbFilterAllow UsbFilterAction = iota
+	UsbFilterDeny
+)
+
+// UsbFilterRule is a single allow/deny rule, parsed from one [filter]
+// stanza in ipp-usb.conf. A nil Vendor/Product/InterfaceClass, or an
+// empty/"*" Serial, matches any value
+type UsbFilterRule struct {
+	Action         UsbFilterAction
+	Vendor         *uint16
+	Product        *uint16
+	Serial         string // shell glob, "" or "*" matches anything
+	InterfaceClass *uint8
+}
+
+// Match reports if rule matches desc
+func (rule UsbFilterRule) Match(desc UsbDeviceDesc) bool {
+	if rule.Vendor != nil && *rule.Vendor != desc.Vendor {
+		return false
+	}
+	if rule.Product != nil && *rule.Product != desc.Product {
+		return false
+	}
+	if rule.Serial != "" && rule.Serial != "*" {
+		if ok, _ := path.Match(rule.Serial, desc.SerialNumber); !ok {
+			return false
+		}
+	}
+	if rule.InterfaceClass != nil && *rule.InterfaceClass != desc.InterfaceClass {
+		return false
+	}
+
+	return true
+}
+
+// UsbFilter is the effective set of allow/deny rules, built once at
+// startup from all [filter] stanzas in ipp-usb.conf, in the order they
+// appear there
+type UsbFilter struct {
+	Rules []UsbFilterRule
+}
+
+// Allowed evaluates desc against the filter and reports whether the
+// device should be served. Rules are checked in order; the last
+// matching rule wins. A device matched by no rule at all is allowed
+func (f *UsbFilter) Allowed(desc UsbDeviceDesc) bool {
+	allowed := true
+	for _, rule := range f.Rules {
+		if rule.Match(desc) {
+			allowed = rule.Action == UsbFilterAllow
+		}
+	}
+
+	return allowed
+}
+
+// parseUsbFilterHex parses a hex vendor/product ID, honoring the "*"
+// wildcard (which parseUsbFilterHex reports as a nil pointer)
+func parseUsbFilterHex(s string) (*uint16, error) {
+	if s == "" || s == "*" {
+		return nil, nil
+	}
+
+	v, err := strconv.ParseUint(s, 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex value %q: %s", s, err)
+	}
+
+	v16 := uint16(v)
+	return &v16, nil
+}
+
+// ParseUsbFilterRule parses a single [filter] stanza
+func ParseUsbFilterRule(sec *ini.Section) (UsbFilterRule, error) {
+	rule := UsbFilterRule{}
+
+	switch action := sec.Key("action").MustString("allow"); action {
+	case "allow":
+		rule.Action = UsbFilterAllow
+	case "deny":
+		rule.Action = UsbFilterDeny
+	default:
+		return rule, fmt.Errorf("filter: invalid action %q", action)
+	}
+
+	var err error
+	rule.Vendor, err = parseUsbFilterHex(sec.Key("vendor").String())
+	if err != nil {
+		return rule, fmt.Errorf("filter: vendor: %s", err)
+	}
+
+	rule.Product, err = parseUsbFilterHex(sec.Key("product").String())
+	if err != nil {
+		return rule, fmt.Errorf("filter: product: %s", err)
+	}
+
+	rule.Serial = sec.Key("serial").MustString("*")
+
+	if s := sec.Key("interface-class").String(); s != "" && s != "*" {
+		class, err := strconv.ParseUint(s, 16, 8)
+		if err != nil {
+			return rule, fmt.Errorf("filter: interface-class: invalid value %q: %s", s, err)
+		}
+		class8 := uint8(class)
+		rule.InterfaceClass = &class8
+	}
+
+	return rule, nil
+}
+
+// NewUsbFilter builds the effective UsbFilter from every [filter]
+// stanza found in cfg, preserving their order.
+//
+// cfg must have been loaded with ini.LoadOptions.AllowNonUniqueSections
+// set (see loadIniFile): ipp-usb.conf repeats the "filter" section
+// header once per rule, and without that option ini.v1 merges same-
+// named sections into one, silently collapsing all but the last rule.
+func NewUsbFilter(cfg *ini.File) (*UsbFilter, error) {
+	filter := &UsbFilter{}
+
+	for _, sec := range cfg.Sections() {
+		if sec.Name() != "filter" {
+			continue
+		}
+
+		rule, err := ParseUsbFilterRule(sec)
+		if err != nil {
+			return nil, err
+		}
+
+		filter.Rules = append(filter.Rules, rule)
+	}
+
+	return filter, nil
+}
+
+// pnpFilter is the filter consulted by PnPStart before attaching a
+// newly seen device. nil means "allow everything" (the default)
+var pnpFilter *UsbFilter
+
+// PnPSetFilter installs the USB allow/deny filter PnPStart consults. It
+// must be called before PnPStart, typically from main() once
+// ipp-usb.conf has been parsed
+func PnPSetFilter(filter *UsbFilter) {
+	pnpFilter = filter
+}
+
+// CheckFilter implements the --check-filter CLI mode: it evaluates every
+// currently attached IPP-over-USB device against filter and prints
+// whether each would be accepted or rejected, without starting the
+// daemon or touching any device
+func CheckFilter(filter *UsbFilter) error {
+	descs, err := UsbGetIppOverUsbDeviceDescs()
+	if err != nil {
+		return err
+	}
+
+	if len(descs) == 0 {
+		fmt.Println("No IPP-over-USB devices found")
+		return nil
+	}
+
+	for _, desc := range descs {
+		verdict := "accept"
+		if filter != nil && !filter.Allowed(desc) {
+			verdict = "reject"
+		}
+
+		fmt.Fprintf(os.Stdout, "%s: vendor=%04x product=%04x serial=%q: %s\n",
+			desc.UsbAddr, desc.Vendor, desc.Product, desc.SerialNumber, verdict)
+	}
+
+	return nil
+}
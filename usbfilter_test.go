@@ -0,0 +1,125 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * USB device allow/deny filtering
+ */
+
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+func mkVendor(v uint16) *uint16 { return &v }
+
+func TestUsbFilterRuleMatch(t *testing.T) {
+	epson := mkVendor(0x04b8)
+
+	tests := []struct {
+		name string
+		rule UsbFilterRule
+		desc UsbDeviceDesc
+		want bool
+	}{
+		{
+			name: "vendor mismatch",
+			rule: UsbFilterRule{Vendor: epson},
+			desc: UsbDeviceDesc{Vendor: 0x03f0},
+			want: false,
+		},
+		{
+			name: "vendor match, wildcard product/serial",
+			rule: UsbFilterRule{Vendor: epson},
+			desc: UsbDeviceDesc{Vendor: 0x04b8, SerialNumber: "ABC123"},
+			want: true,
+		},
+		{
+			name: "serial glob match",
+			rule: UsbFilterRule{Serial: "ABC*"},
+			desc: UsbDeviceDesc{SerialNumber: "ABC123"},
+			want: true,
+		},
+		{
+			name: "serial glob mismatch",
+			rule: UsbFilterRule{Serial: "XYZ*"},
+			desc: UsbDeviceDesc{SerialNumber: "ABC123"},
+			want: false,
+		},
+		{
+			name: "empty rule matches anything",
+			rule: UsbFilterRule{},
+			desc: UsbDeviceDesc{Vendor: 0x1234, Product: 0x5678, SerialNumber: "whatever"},
+			want: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.rule.Match(test.desc); got != test.want {
+				t.Errorf("Match() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUsbFilterAllowedLastMatchWins(t *testing.T) {
+	epson := mkVendor(0x04b8)
+
+	filter := &UsbFilter{
+		Rules: []UsbFilterRule{
+			{Action: UsbFilterDeny}, // deny everything...
+			{Action: UsbFilterAllow, Vendor: epson}, // ...except Epson
+		},
+	}
+
+	if !filter.Allowed(UsbDeviceDesc{Vendor: 0x04b8}) {
+		t.Errorf("Epson device should be allowed (last matching rule wins)")
+	}
+	if filter.Allowed(UsbDeviceDesc{Vendor: 0x03f0}) {
+		t.Errorf("HP device should be denied")
+	}
+}
+
+func TestUsbFilterAllowedDefaultAllow(t *testing.T) {
+	filter := &UsbFilter{}
+	if !filter.Allowed(UsbDeviceDesc{Vendor: 0x04b8}) {
+		t.Errorf("a device matched by no rule at all must be allowed by default")
+	}
+}
+
+func TestNewUsbFilterRepeatedSections(t *testing.T) {
+	const conf = `
+[filter]
+action = deny
+vendor = *
+
+[filter]
+action = allow
+vendor = 04b8
+`
+
+	cfg, err := ini.LoadSources(ini.LoadOptions{AllowNonUniqueSections: true}, []byte(conf))
+	if err != nil {
+		t.Fatalf("failed to load test config: %s", err)
+	}
+
+	filter, err := NewUsbFilter(cfg)
+	if err != nil {
+		t.Fatalf("NewUsbFilter: %s", err)
+	}
+
+	if len(filter.Rules) != 2 {
+		t.Fatalf("expected 2 rules from 2 repeated [filter] stanzas, got %d", len(filter.Rules))
+	}
+
+	if !filter.Allowed(UsbDeviceDesc{Vendor: 0x04b8}) {
+		t.Errorf("Epson device should be allowed by the second rule")
+	}
+	if filter.Allowed(UsbDeviceDesc{Vendor: 0x03f0}) {
+		t.Errorf("non-Epson device should be denied by the first rule")
+	}
+}